@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// AccountConfig overrides the shared, environment-derived defaults for one
+// mailbox. Name, IMAPServer, IMAPUser and IMAPPassword are required; every
+// other field falls back to the corresponding top-level env var when empty.
+type AccountConfig struct {
+	Name         string `yaml:"name"`
+	IMAPServer   string `yaml:"imap_server"`
+	IMAPPort     string `yaml:"imap_port"`
+	IMAPUser     string `yaml:"imap_user"`
+	IMAPPassword string `yaml:"imap_password"`
+	LexofficeKey string `yaml:"lexoffice_api_key"`
+	Backend      string `yaml:"backend"`
+	RulesFile    string `yaml:"rules_file"`
+	PollMinutes  int    `yaml:"poll_interval_minutes"`
+}
+
+// accountsFile is the top-level shape of the ACCOUNTS_FILE YAML document.
+type accountsFile struct {
+	Accounts []AccountConfig `yaml:"accounts"`
+}
+
+func loadAccountsFile(path string) ([]AccountConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read accounts file: %w", err)
+	}
+
+	var af accountsFile
+	if err := yaml.Unmarshal(data, &af); err != nil {
+		return nil, fmt.Errorf("failed to parse accounts file: %w", err)
+	}
+	if len(af.Accounts) == 0 {
+		return nil, fmt.Errorf("accounts file has no accounts")
+	}
+
+	for i, acc := range af.Accounts {
+		if acc.Name == "" {
+			return nil, fmt.Errorf("account %d: name is required", i)
+		}
+		if acc.IMAPServer == "" || acc.IMAPUser == "" || acc.IMAPPassword == "" {
+			return nil, fmt.Errorf("account %s: imap_server, imap_user and imap_password are required", acc.Name)
+		}
+	}
+
+	return af.Accounts, nil
+}
+
+// buildConfig merges acc onto the shared defaults in base (Search,
+// Attachments, State, uploadSem, ...) to produce a ready-to-run Config for
+// one account.
+func buildConfig(base *Config, acc AccountConfig) (*Config, error) {
+	cfg := *base
+
+	// Each account polls its own IMAP connection, so it gets its own connMu
+	// rather than serializing IMAP commands across unrelated accounts.
+	cfg.connMu = &sync.Mutex{}
+
+	cfg.AccountName = acc.Name
+	cfg.IMAPServer = acc.IMAPServer
+	cfg.IMAPPort = firstNonEmpty(acc.IMAPPort, base.IMAPPort)
+	cfg.IMAPUser = acc.IMAPUser
+	cfg.IMAPPassword = acc.IMAPPassword
+	cfg.LexofficeKey = firstNonEmpty(acc.LexofficeKey, base.LexofficeKey)
+	cfg.Backend = firstNonEmpty(acc.Backend, base.Backend)
+
+	if acc.PollMinutes > 0 {
+		cfg.PollInterval = time.Duration(acc.PollMinutes) * time.Minute
+	}
+
+	rulesFile := firstNonEmpty(acc.RulesFile, os.Getenv("RULES_FILE"))
+	rules, err := loadRules(rulesFile)
+	if err != nil {
+		return nil, fmt.Errorf("account %s: %w", acc.Name, err)
+	}
+	cfg.Rules = rules
+
+	uploader, err := newUploader(&cfg)
+	if err != nil {
+		return nil, fmt.Errorf("account %s: %w", acc.Name, err)
+	}
+	cfg.Uploader = newLimitedUploader(uploader, cfg.uploadSem)
+
+	return &cfg, nil
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
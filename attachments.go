@@ -0,0 +1,120 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-imap/v2"
+)
+
+// AttachmentConfig bounds which attachment parts get fetched, so a single
+// huge inline image or an oversized newsletter attachment doesn't pull an
+// entire message body over the wire.
+type AttachmentConfig struct {
+	MaxSizeBytes     int64
+	AllowedMimeTypes []string
+}
+
+func loadAttachmentConfig() *AttachmentConfig {
+	ac := &AttachmentConfig{MaxSizeBytes: 25 * 1024 * 1024}
+
+	if val := os.Getenv("MAX_ATTACHMENT_SIZE_MB"); val != "" {
+		if mb, err := strconv.ParseInt(val, 10, 64); err == nil {
+			ac.MaxSizeBytes = mb * 1024 * 1024
+		}
+	}
+	if val := os.Getenv("ALLOWED_MIME_TYPES"); val != "" {
+		for _, t := range strings.Split(val, ",") {
+			if t = strings.ToLower(strings.TrimSpace(t)); t != "" {
+				ac.AllowedMimeTypes = append(ac.AllowedMimeTypes, t)
+			}
+		}
+	}
+
+	return ac
+}
+
+func (ac *AttachmentConfig) allows(mimeType string, size uint32) bool {
+	if ac.MaxSizeBytes > 0 && int64(size) > ac.MaxSizeBytes {
+		return false
+	}
+	if len(ac.AllowedMimeTypes) == 0 {
+		return true
+	}
+	for _, allowed := range ac.AllowedMimeTypes {
+		if allowed == strings.ToLower(mimeType) {
+			return true
+		}
+	}
+	return false
+}
+
+// attachmentPart describes one accepted attachment found while walking a
+// message's BODYSTRUCTURE.
+type attachmentPart struct {
+	section  *imap.FetchItemBodySection
+	filename string
+	mimeType string
+	size     uint32
+}
+
+// findAttachmentParts walks bs depth-first and returns every part that looks
+// like an attachment and fits within config. Whether a given part should
+// actually be skipped (hard-coded IgnorePatterns, or a rules file) is a
+// policy decision made by the caller, not here.
+func findAttachmentParts(bs imap.BodyStructure, config *AttachmentConfig) []attachmentPart {
+	var parts []attachmentPart
+	walkBodyStructure(bs, nil, config, &parts)
+	return parts
+}
+
+func walkBodyStructure(bs imap.BodyStructure, path []int, config *AttachmentConfig, parts *[]attachmentPart) {
+	switch b := bs.(type) {
+	case *imap.BodyStructureMultiPart:
+		for i, child := range b.Children {
+			walkBodyStructure(child, append(append([]int{}, path...), i+1), config, parts)
+		}
+	case *imap.BodyStructureSinglePart:
+		filename := singlePartFilename(b)
+		if filename == "" || !isAttachment(b) {
+			return
+		}
+
+		mimeType := strings.ToLower(b.Type + "/" + b.Subtype)
+		if !config.allows(mimeType, b.Size) {
+			return
+		}
+
+		*parts = append(*parts, attachmentPart{
+			section:  &imap.FetchItemBodySection{Part: append([]int{}, path...)},
+			filename: filename,
+			mimeType: mimeType,
+			size:     b.Size,
+		})
+	}
+}
+
+func isAttachment(b *imap.BodyStructureSinglePart) bool {
+	if b.Extended == nil || b.Extended.Disposition == nil {
+		// Some senders never set Content-Disposition; anything with a
+		// filename is still worth treating as an attachment.
+		return singlePartFilename(b) != ""
+	}
+	// Disposition is present and explicit: respect it. "inline" parts (e.g.
+	// signature logos with a Content-Type name) are not attachments even if
+	// they carry a filename.
+	return strings.EqualFold(b.Extended.Disposition.Value, "attachment")
+}
+
+func singlePartFilename(b *imap.BodyStructureSinglePart) string {
+	if b.Extended != nil && b.Extended.Disposition != nil {
+		if name, ok := b.Extended.Disposition.Params["filename"]; ok && name != "" {
+			return name
+		}
+	}
+	if name, ok := b.Params["name"]; ok {
+		return name
+	}
+	return ""
+}
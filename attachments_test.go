@@ -0,0 +1,87 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-imap/v2"
+)
+
+func singlePart(disposition, filename, mimeType string, nameParam string, size uint32) *imap.BodyStructureSinglePart {
+	typ, subtype, _ := strings.Cut(mimeType, "/")
+
+	part := &imap.BodyStructureSinglePart{
+		Type:    typ,
+		Subtype: subtype,
+		Size:    size,
+	}
+	if nameParam != "" {
+		part.Params = map[string]string{"name": nameParam}
+	}
+	if disposition != "" {
+		part.Extended = &imap.BodyStructureSinglePartExt{
+			Disposition: &imap.BodyStructureDisposition{
+				Value:  disposition,
+				Params: map[string]string{"filename": filename},
+			},
+		}
+	}
+	return part
+}
+
+func TestIsAttachment(t *testing.T) {
+	tests := []struct {
+		name string
+		part *imap.BodyStructureSinglePart
+		want bool
+	}{
+		{
+			name: "explicit attachment disposition",
+			part: singlePart("attachment", "invoice.pdf", "application/pdf", "", 100),
+			want: true,
+		},
+		{
+			name: "inline disposition with a Content-Type name is not an attachment",
+			part: singlePart("inline", "", "image/png", "logo.png", 100),
+			want: false,
+		},
+		{
+			name: "no disposition at all falls back to the Content-Type name",
+			part: singlePart("", "", "application/pdf", "receipt.pdf", 100),
+			want: true,
+		},
+		{
+			name: "no disposition and no name",
+			part: singlePart("", "", "text/plain", "", 100),
+			want: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isAttachment(tt.part); got != tt.want {
+				t.Errorf("isAttachment() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFindAttachmentParts(t *testing.T) {
+	config := &AttachmentConfig{MaxSizeBytes: 1024}
+
+	bs := &imap.BodyStructureMultiPart{
+		Children: []imap.BodyStructure{
+			singlePart("inline", "", "image/png", "logo.png", 100),
+			singlePart("attachment", "invoice.pdf", "application/pdf", "", 500),
+			singlePart("attachment", "huge.pdf", "application/pdf", "", 2048),
+		},
+	}
+
+	parts := findAttachmentParts(bs, config)
+	if len(parts) != 1 {
+		t.Fatalf("findAttachmentParts() returned %d parts, want 1 (inline part and oversized part excluded): %+v", len(parts), parts)
+	}
+	if parts[0].filename != "invoice.pdf" {
+		t.Errorf("findAttachmentParts()[0].filename = %q, want %q", parts[0].filename, "invoice.pdf")
+	}
+}
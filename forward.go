@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"net/smtp"
+	"os"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapclient"
+)
+
+// SMTPConfig holds the outgoing-mail settings used by the forward_to rule
+// action. It's only required when a rules file actually uses forward_to.
+type SMTPConfig struct {
+	Server   string
+	Port     string
+	User     string
+	Password string
+}
+
+func loadSMTPConfig(config *Config) *SMTPConfig {
+	return &SMTPConfig{
+		Server:   os.Getenv("SMTP_SERVER"),
+		Port:     getEnvOrDefault("SMTP_PORT", "587"),
+		User:     getEnvOrDefault("SMTP_USER", config.IMAPUser),
+		Password: getEnvOrDefault("SMTP_PASSWORD", config.IMAPPassword),
+	}
+}
+
+// forwardMessage fetches the raw message for uid and relays it unmodified to
+// to via SMTP.
+func forwardMessage(c *imapclient.Client, uid imap.UID, to string, smtpConfig *SMTPConfig, config *Config) error {
+	if smtpConfig.Server == "" {
+		return fmt.Errorf("SMTP_SERVER is not configured, cannot forward to %s", to)
+	}
+
+	raw, err := fetchBodyPart(c, uid, &imap.FetchItemBodySection{}, config)
+	if err != nil {
+		return fmt.Errorf("failed to fetch message for forwarding: %w", err)
+	}
+
+	auth := smtp.PlainAuth("", smtpConfig.User, smtpConfig.Password, smtpConfig.Server)
+	addr := smtpConfig.Server + ":" + smtpConfig.Port
+
+	if err := smtp.SendMail(addr, auth, smtpConfig.User, []string{to}, raw); err != nil {
+		return fmt.Errorf("failed to send message to %s: %w", to, err)
+	}
+
+	return nil
+}
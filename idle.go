@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapclient"
+)
+
+// idleRenewInterval is how often we re-issue IDLE. RFC 2177 requires the
+// server to be allowed to drop the connection after 29 minutes of inactivity,
+// so we renew well before that.
+const idleRenewInterval = 25 * time.Minute
+
+// maxReconnectBackoff caps the exponential backoff used when the IMAP
+// connection drops unexpectedly.
+const maxReconnectBackoff = 5 * time.Minute
+
+// run connects to the IMAP server and processes messages either via IDLE
+// push notifications, when the server supports it, or by falling back to
+// polling every config.PollInterval. It blocks until ctx is cancelled.
+func run(ctx context.Context, config *Config) {
+	backoff := time.Second
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+
+		useIdle, err := watchMailbox(ctx, config)
+		if err != nil {
+			log.Printf("Mailbox watch failed: %v", err)
+		}
+		if ctx.Err() != nil {
+			return
+		}
+
+		if useIdle || err != nil {
+			// An ended IDLE session or a failed dial/login/capability check
+			// is transient; reconnect with backoff rather than hammering the
+			// server.
+			log.Printf("Reconnecting in %v...", backoff)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+			if backoff > maxReconnectBackoff {
+				backoff = maxReconnectBackoff
+			}
+			continue
+		}
+
+		// IDLE isn't supported: fall back to the polling ticker.
+		pollLoop(ctx, config)
+		return
+	}
+}
+
+// pollLoop processes the mailbox once and then again every
+// config.PollInterval until ctx is cancelled.
+func pollLoop(ctx context.Context, config *Config) {
+	log.Printf("Server does not support IDLE, polling every %v", config.PollInterval)
+
+	ticker := time.NewTicker(config.PollInterval)
+	defer ticker.Stop()
+
+	processMailbox(config)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			processMailbox(config)
+		}
+	}
+}
+
+// watchMailbox opens a single IMAP connection and, if the server advertises
+// the IDLE capability, keeps it open and processes new messages as EXISTS
+// notifications arrive. It returns useIdle=true once the server is known to
+// support IDLE; useIdle=false with a nil error means the server lacks IDLE,
+// so the caller knows to fall back to polling.
+func watchMailbox(ctx context.Context, config *Config) (useIdle bool, err error) {
+	newMessages := make(chan struct{}, 1)
+
+	options := &imapclient.Options{
+		UnilateralDataHandler: &imapclient.UnilateralDataHandler{
+			Mailbox: func(data *imapclient.UnilateralDataMailbox) {
+				if data.NumMessages != nil {
+					select {
+					case newMessages <- struct{}{}:
+					default:
+					}
+				}
+			},
+		},
+	}
+
+	c, err := imapclient.DialTLS(config.IMAPServer+":"+config.IMAPPort, options)
+	if err != nil {
+		return false, fmt.Errorf("dial failed: %w", err)
+	}
+	defer c.Close()
+
+	if err := c.Login(config.IMAPUser, config.IMAPPassword).Wait(); err != nil {
+		return false, fmt.Errorf("login failed: %w", err)
+	}
+	log.Println("Logged in successfully")
+
+	caps, err := c.Capability().Wait()
+	if err != nil {
+		return false, fmt.Errorf("capability failed: %w", err)
+	}
+	if !caps.Has(imap.CapIDLE) {
+		return false, nil
+	}
+
+	if _, err := c.Select("INBOX", nil).Wait(); err != nil {
+		return true, fmt.Errorf("failed to select INBOX: %w", err)
+	}
+
+	processMailboxConn(c, config)
+
+	for {
+		idleCmd, err := c.Idle()
+		if err != nil {
+			return true, fmt.Errorf("idle failed: %w", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			idleCmd.Close()
+			return true, nil
+		case <-newMessages:
+			if err := idleCmd.Close(); err != nil {
+				return true, fmt.Errorf("idle close failed: %w", err)
+			}
+			processMailboxConn(c, config)
+		case <-time.After(idleRenewInterval):
+			if err := idleCmd.Close(); err != nil {
+				return true, fmt.Errorf("idle renew failed: %w", err)
+			}
+		}
+	}
+}
+
+// notifyContext returns a context that is cancelled on SIGINT or SIGTERM.
+func notifyContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+
+	go func() {
+		<-sigCh
+		log.Println("Shutting down...")
+		signal.Stop(sigCh)
+		cancel()
+	}()
+
+	return ctx, cancel
+}
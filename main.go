@@ -1,33 +1,52 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"flag"
 	"fmt"
-	"io"
 	"log"
-	"mime/multipart"
-	"net/http"
 	"os"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/emersion/go-imap/v2"
 	"github.com/emersion/go-imap/v2/imapclient"
-	"github.com/emersion/go-message/mail"
 )
 
 type Config struct {
+	AccountName  string
 	IMAPServer   string
 	IMAPPort     string
 	IMAPUser     string
 	IMAPPassword string
 	LexofficeKey string
+	Backend      string
 	PollInterval time.Duration
+	Search       *SearchConfig
+	Attachments  *AttachmentConfig
+	Uploader     Uploader
+	State        *StateStore
+	Rules        *RuleSet
+	SMTP         *SMTPConfig
+
+	MaxConcurrentMessages int
+	uploadSem             chan struct{}
+
+	// connMu serializes every command processMailboxConn's worker pool issues
+	// on the one shared *imapclient.Client: FETCH, COPY, STORE and EXPUNGE are
+	// not safe to interleave across goroutines on a single IMAP session, since
+	// EXPUNGE renumbers every remaining message and a response can otherwise be
+	// attributed to the wrong in-flight command. Only the non-IMAP work of
+	// processMessage (the Uploader.Upload call, state store access and the
+	// SMTP send of a forward) runs outside this lock.
+	connMu *sync.Mutex
 }
 
-// IgnorePatterns contains regex patterns for files to ignore during upload
+// IgnorePatterns contains regex patterns for files to ignore during upload.
+// It's the default filter used when no RULES_FILE is configured.
 var IgnorePatterns = []*regexp.Regexp{
 	regexp.MustCompile(`^AGB_`),
 	regexp.MustCompile(`.ics$`),
@@ -43,13 +62,33 @@ func loadConfig() *Config {
 		}
 	}
 
+	maxConcurrentMessages := 4
+	if val := os.Getenv("MAX_CONCURRENT_MESSAGES"); val != "" {
+		if n, err := strconv.Atoi(val); err == nil && n > 0 {
+			maxConcurrentMessages = n
+		}
+	}
+
+	var uploadSem chan struct{}
+	if val := os.Getenv("MAX_CONCURRENT_UPLOADS"); val != "" {
+		if n, err := strconv.Atoi(val); err == nil && n > 0 {
+			uploadSem = make(chan struct{}, n)
+		}
+	}
+
 	return &Config{
-		IMAPServer:   os.Getenv("IMAP_SERVER"),
-		IMAPPort:     getEnvOrDefault("IMAP_PORT", "993"),
-		IMAPUser:     os.Getenv("IMAP_USER"),
-		IMAPPassword: os.Getenv("IMAP_PASSWORD"),
-		LexofficeKey: os.Getenv("LEXOFFICE_API_KEY"),
-		PollInterval: interval,
+		IMAPServer:            os.Getenv("IMAP_SERVER"),
+		IMAPPort:              getEnvOrDefault("IMAP_PORT", "993"),
+		IMAPUser:              os.Getenv("IMAP_USER"),
+		IMAPPassword:          os.Getenv("IMAP_PASSWORD"),
+		LexofficeKey:          os.Getenv("LEXOFFICE_API_KEY"),
+		Backend:               getEnvOrDefault("BACKEND", "lexoffice"),
+		PollInterval:          interval,
+		Search:                loadSearchConfig(),
+		Attachments:           loadAttachmentConfig(),
+		MaxConcurrentMessages: maxConcurrentMessages,
+		uploadSem:             uploadSem,
+		connMu:                &sync.Mutex{},
 	}
 }
 
@@ -66,28 +105,78 @@ func main() {
 
 	config := loadConfig()
 
-	if config.IMAPServer == "" || config.IMAPUser == "" || config.IMAPPassword == "" || config.LexofficeKey == "" {
-		log.Fatal("Missing required environment variables: IMAP_SERVER, IMAP_USER, IMAP_PASSWORD, LEXOFFICE_API_KEY")
+	if path := os.Getenv("STATE_DB_PATH"); path != "" {
+		state, err := openStateStore(path)
+		if err != nil {
+			log.Fatalf("Failed to open state store: %v", err)
+		}
+		defer state.Close()
+		config.State = state
+	}
+
+	rules, err := loadRules(os.Getenv("RULES_FILE"))
+	if err != nil {
+		log.Fatalf("Failed to load rules file: %v", err)
 	}
+	config.Rules = rules
+	config.SMTP = loadSMTPConfig(config)
+
+	accountsPath := os.Getenv("ACCOUNTS_FILE")
+	if accountsPath == "" {
+		if config.IMAPServer == "" || config.IMAPUser == "" || config.IMAPPassword == "" {
+			log.Fatal("Missing required environment variables: IMAP_SERVER, IMAP_USER, IMAP_PASSWORD")
+		}
+		if config.Backend == "lexoffice" && config.LexofficeKey == "" {
+			log.Fatal("Missing required environment variable: LEXOFFICE_API_KEY")
+		}
 
-	if *runOnce {
-		log.Println("Running once and exiting...")
-		processMailbox(config)
+		uploader, err := newUploader(config)
+		if err != nil {
+			log.Fatalf("Failed to set up %s backend: %v", config.Backend, err)
+		}
+		config.Uploader = newLimitedUploader(uploader, config.uploadSem)
+
+		if *runOnce {
+			log.Println("Running once and exiting...")
+			processMailbox(config)
+			return
+		}
+
+		ctx, cancel := notifyContext()
+		defer cancel()
+
+		log.Println("Starting mail processor...")
+		run(ctx, config)
 		return
 	}
 
-	log.Printf("Starting mail processor. Polling every %v", config.PollInterval)
+	accounts, err := loadAccountsFile(accountsPath)
+	if err != nil {
+		log.Fatalf("Failed to load accounts file: %v", err)
+	}
 
-	ticker := time.NewTicker(config.PollInterval)
-	defer ticker.Stop()
+	ctx, cancel := notifyContext()
+	defer cancel()
 
-	// Process immediately on startup
-	processMailbox(config)
+	var wg sync.WaitGroup
+	for _, acc := range accounts {
+		acctConfig, err := buildConfig(config, acc)
+		if err != nil {
+			log.Fatalf("Failed to configure account %q: %v", acc.Name, err)
+		}
 
-	// Then process on ticker
-	for range ticker.C {
-		processMailbox(config)
+		wg.Add(1)
+		go func(name string, cfg *Config) {
+			defer wg.Done()
+			log.Printf("[%s] Starting mail processor...", name)
+			if *runOnce {
+				processMailbox(cfg)
+				return
+			}
+			run(ctx, cfg)
+		}(acc.Name, acctConfig)
 	}
+	wg.Wait()
 }
 
 func processMailbox(config *Config) {
@@ -107,63 +196,153 @@ func processMailbox(config *Config) {
 
 	log.Println("Logged in successfully")
 
-	// Select INBOX
-	mailbox, err := c.Select("INBOX", nil).Wait()
-	if err != nil {
+	if _, err := c.Select("INBOX", nil).Wait(); err != nil {
 		log.Printf("Failed to select INBOX: %v", err)
 		return
 	}
 
-	if mailbox.NumMessages == 0 {
+	processMailboxConn(c, config)
+
+	// Logout
+	if err := c.Logout().Wait(); err != nil {
+		log.Printf("Logout failed: %v", err)
+	}
+}
+
+// processMailboxConn processes every message in the selected mailbox that
+// matches config.Search (including its post-filters) on an
+// already-connected, already-selected client. It's shared by
+// the polling path, which opens a fresh connection each run, and the IDLE
+// path, which reuses one connection across many processing rounds.
+func processMailboxConn(c *imapclient.Client, config *Config) {
+	mailbox := c.Mailbox()
+	if mailbox == nil || mailbox.NumMessages == 0 {
 		log.Println("No messages in INBOX")
 		return
 	}
 
 	log.Printf("Found %d messages in INBOX", mailbox.NumMessages)
 
-	// Fetch all messages
-	seqSet := imap.SeqSet{}
-	seqSet.AddRange(1, mailbox.NumMessages)
-
-	fetchOptions := &imap.FetchOptions{
-		UID: true,
-	}
-
-	msgs, err := c.Fetch(seqSet, fetchOptions).Collect()
+	uids, err := c.UIDSearch(config.Search.buildCriteria(), nil).Wait()
 	if err != nil {
-		log.Printf("Failed to fetch messages: %v", err)
+		log.Printf("Search failed: %v", err)
 		return
 	}
 
-	log.Printf("Processing %d messages from INBOX", len(msgs))
+	if len(uids.AllUIDs()) == 0 {
+		log.Println("No messages match the configured search criteria")
+		return
+	}
 
-	// Process each message
-	for _, msg := range msgs {
-		if err := processMessage(c, msg.UID, config); err != nil {
-			log.Printf("Failed to process message %d: %v", msg.UID, err)
+	matchingUIDs := uids.AllUIDs()
+	if config.Search.HasAttachment || config.Search.subjectRegex != nil {
+		matchingUIDs = filterSearchResults(c, matchingUIDs, config)
+		if len(matchingUIDs) == 0 {
+			log.Println("No matching messages survive the configured post-filters")
+			return
 		}
 	}
 
-	// Logout
-	if err := c.Logout().Wait(); err != nil {
-		log.Printf("Logout failed: %v", err)
+	log.Printf("Processing %d matching messages from INBOX", len(matchingUIDs))
+
+	workers := config.MaxConcurrentMessages
+	if workers <= 0 {
+		workers = 1
 	}
+
+	sem := make(chan struct{}, workers)
+	var wg sync.WaitGroup
+
+	for _, uid := range matchingUIDs {
+		uid := uid
+
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			if err := processMessage(c, uid, config); err != nil {
+				log.Printf("Failed to process message %d: %v", uid, err)
+			}
+		}()
+	}
+
+	wg.Wait()
 }
 
-func processMessage(c *imapclient.Client, uid imap.UID, config *Config) error {
-	log.Printf("Processing message UID %d", uid)
+// filterSearchResults applies the SEARCH_* criteria that have no IMAP SEARCH
+// equivalent (SEARCH_HAS_ATTACHMENT, SEARCH_SUBJECT_REGEX) by fetching each
+// candidate UID's Envelope and/or BODYSTRUCTURE and re-checking it locally.
+// This runs as a sequential pre-pass before the worker pool in
+// processMailboxConn is given any UIDs to process concurrently, so it doesn't
+// need config.connMu.
+func filterSearchResults(c *imapclient.Client, uids []imap.UID, config *Config) []imap.UID {
+	fetchOptions := &imap.FetchOptions{UID: true}
+	if config.Search.subjectRegex != nil {
+		fetchOptions.Envelope = true
+	}
+	if config.Search.HasAttachment {
+		fetchOptions.BodyStructure = &imap.FetchItemBodyStructure{}
+	}
 
-	fetchOptions := &imap.FetchOptions{
-		UID:         true,
-		BodySection: []*imap.FetchItemBodySection{{}},
+	var matched []imap.UID
+
+	for _, uid := range uids {
+		seqSet := imap.UIDSet{}
+		seqSet.AddNum(uid)
+
+		msgs, err := c.Fetch(seqSet, fetchOptions).Collect()
+		if err != nil {
+			log.Printf("Failed to fetch message %d for search post-filter: %v", uid, err)
+			continue
+		}
+		if len(msgs) == 0 {
+			continue
+		}
+		msg := msgs[0]
+
+		if config.Search.subjectRegex != nil {
+			subject := ""
+			if msg.Envelope != nil {
+				subject = msg.Envelope.Subject
+			}
+			if !config.Search.matchesSubjectRegex(subject) {
+				continue
+			}
+		}
+
+		if config.Search.HasAttachment {
+			if msg.BodyStructure == nil || len(findAttachmentParts(msg.BodyStructure, config.Attachments)) == 0 {
+				continue
+			}
+		}
+
+		matched = append(matched, uid)
 	}
 
+	return matched
+}
+
+func processMessage(c *imapclient.Client, uid imap.UID, config *Config) error {
+	log.Printf("Processing message UID %d", uid)
+
 	seqSet := imap.UIDSet{}
 	seqSet.AddNum(uid)
 
-	msgs, err := c.Fetch(seqSet, fetchOptions).Collect()
+	// First, fetch only the envelope and BODYSTRUCTURE so we know which
+	// parts are attachments before pulling any message bytes over the wire.
+	structFetchOptions := &imap.FetchOptions{
+		UID:           true,
+		Envelope:      true,
+		BodyStructure: &imap.FetchItemBodyStructure{},
+	}
+
+	config.connMu.Lock()
+	msgs, err := c.Fetch(seqSet, structFetchOptions).Collect()
+	config.connMu.Unlock()
 	if err != nil {
-		return fmt.Errorf("fetch failed: %w", err)
+		return fmt.Errorf("fetch bodystructure failed: %w", err)
 	}
 
 	if len(msgs) == 0 {
@@ -172,133 +351,156 @@ func processMessage(c *imapclient.Client, uid imap.UID, config *Config) error {
 
 	msg := msgs[0]
 
-	// Get the message body
-	var bodyReader io.Reader
-	for _, literal := range msg.BodySection {
-		bodyReader = bytes.NewReader(literal.Bytes)
-		break
+	meta := UploadMeta{}
+	if msg.Envelope != nil {
+		meta.MessageID = msg.Envelope.MessageID
+		meta.Subject = msg.Envelope.Subject
+		if len(msg.Envelope.From) > 0 {
+			meta.From = msg.Envelope.From[0].Addr()
+		}
 	}
 
-	if bodyReader == nil {
-		return fmt.Errorf("no body found")
+	if msg.BodyStructure == nil {
+		return fmt.Errorf("no bodystructure found")
 	}
 
-	// Parse the email
-	mr, err := mail.CreateReader(bodyReader)
-	if err != nil {
-		return fmt.Errorf("failed to create mail reader: %w", err)
+	parts := findAttachmentParts(msg.BodyStructure, config.Attachments)
+	if len(parts) == 0 {
+		log.Printf("Message %d has no attachments, skipping", uid)
+		return nil
 	}
 
-	hasAttachments := false
+	uploaded := 0
+	moveFolder := "done"
+	forwardTo := ""
+
+	for _, part := range parts {
+		log.Printf("  Found attachment: %s (%s, %d bytes)", part.filename, part.mimeType, part.size)
+
+		rule := config.Rules.match(meta, part.filename, part.mimeType)
 
-	// Process each part
-	for {
-		part, err := mr.NextPart()
-		if err == io.EOF {
-			break
+		// IgnorePatterns is only the fallback for when no RULES_FILE is
+		// configured at all; once rules are in play they fully own
+		// skip/keep decisions; a rule can deliberately re-admit a file that
+		// would otherwise have matched IgnorePatterns.
+		if config.Rules == nil && shouldIgnoreFile(part.filename) {
+			log.Printf("  Skipping %s (matches ignore pattern)", part.filename)
+			continue
 		}
-		if err != nil {
-			return fmt.Errorf("failed to read part: %w", err)
+		if rule != nil && rule.Skip {
+			log.Printf("  Skipping %s (rule match)", part.filename)
+			continue
+		}
+		if rule != nil && rule.MoveTo != "" {
+			moveFolder = rule.MoveTo
+		}
+		if rule != nil && rule.ForwardTo != "" {
+			forwardTo = rule.ForwardTo
+		}
+		if rule != nil {
+			meta.Category = rule.UploadAs
+			meta.Tag = rule.Tag
 		}
 
-		switch h := part.Header.(type) {
-		case *mail.AttachmentHeader:
-			hasAttachments = true
-			filename, _ := h.Filename()
-			log.Printf("  Found attachment: %s", filename)
+		data, err := fetchBodyPart(c, uid, part.section, config)
+		if err != nil {
+			log.Printf("  Failed to fetch attachment %s: %v", part.filename, err)
+			continue
+		}
 
-			// Check if file should be ignored
-			if shouldIgnoreFile(filename) {
-				log.Printf("  Skipping %s (matches ignore pattern)", filename)
-				continue
-			}
+		hash := sha256Hex(data)
 
-			// Read attachment data
-			data, err := io.ReadAll(part.Body)
+		if config.State != nil {
+			processed, err := config.State.IsProcessed(config.AccountName, hash)
 			if err != nil {
-				log.Printf("  Failed to read attachment: %v", err)
+				log.Printf("  Failed to check state for %s: %v", part.filename, err)
+			} else if processed {
+				log.Printf("  Skipping %s (already uploaded)", part.filename)
+				uploaded++
 				continue
 			}
+		}
 
-			// Upload to Lexoffice
-			if err := uploadToLexoffice(filename, data, config); err != nil {
-				log.Printf("  Failed to upload to Lexoffice: %v", err)
-			} else {
-				log.Printf("  Successfully uploaded %s to Lexoffice", filename)
+		id, err := config.Uploader.Upload(context.Background(), part.filename, part.mimeType, data, meta)
+		if err != nil {
+			log.Printf("  Failed to upload %s: %v", part.filename, err)
+			continue
+		}
+
+		if config.State != nil {
+			record := AttachmentRecord{MessageID: meta.MessageID, Filename: part.filename, UploaderID: id}
+			if err := config.State.MarkProcessed(config.AccountName, hash, record); err != nil {
+				log.Printf("  Failed to record state for %s: %v", part.filename, err)
 			}
 		}
+
+		log.Printf("  Successfully uploaded %s", part.filename)
+		uploaded++
 	}
 
-	if hasAttachments {
-		// Move message to "done" folder
-		if err := moveToFolder(c, uid, "done"); err != nil {
-			return fmt.Errorf("failed to move message: %w", err)
+	if forwardTo != "" {
+		if err := forwardMessage(c, uid, forwardTo, config.SMTP, config); err != nil {
+			log.Printf("Failed to forward message %d to %s: %v", uid, forwardTo, err)
+		} else {
+			log.Printf("Forwarded message %d to %s", uid, forwardTo)
 		}
-		log.Printf("Moved message %d to 'done' folder", uid)
-	} else {
-		log.Printf("Message %d has no attachments, skipping", uid)
 	}
 
-	return nil
-}
-
-func shouldIgnoreFile(filename string) bool {
-	for _, pattern := range IgnorePatterns {
-		if pattern.MatchString(filename) {
-			return true
+	if uploaded > 0 {
+		if err := moveToFolder(c, uid, moveFolder, config); err != nil {
+			return fmt.Errorf("failed to move message: %w", err)
 		}
+		log.Printf("Moved message %d to '%s' folder", uid, moveFolder)
 	}
-	return false
+
+	return nil
 }
 
-func uploadToLexoffice(filename string, data []byte, config *Config) error {
-	body := &bytes.Buffer{}
-	writer := multipart.NewWriter(body)
+// fetchBodyPart fetches a single MIME part of a message by UID and returns
+// its raw bytes. Guarded by config.connMu: see the comment on Config.connMu
+// for why this can't run concurrently with other commands on c.
+func fetchBodyPart(c *imapclient.Client, uid imap.UID, section *imap.FetchItemBodySection, config *Config) ([]byte, error) {
+	seqSet := imap.UIDSet{}
+	seqSet.AddNum(uid)
 
-	// Add file field
-	part, err := writer.CreateFormFile("file", filename)
-	if err != nil {
-		return err
-	}
-	if _, err := part.Write(data); err != nil {
-		return err
+	fetchOptions := &imap.FetchOptions{
+		BodySection: []*imap.FetchItemBodySection{section},
 	}
 
-	// Add type field
-	if err := writer.WriteField("type", "voucher"); err != nil {
-		return err
+	config.connMu.Lock()
+	msgs, err := c.Fetch(seqSet, fetchOptions).Collect()
+	config.connMu.Unlock()
+	if err != nil {
+		return nil, fmt.Errorf("fetch failed: %w", err)
 	}
-
-	if err := writer.Close(); err != nil {
-		return err
+	if len(msgs) == 0 {
+		return nil, fmt.Errorf("message not found")
 	}
 
-	req, err := http.NewRequest("POST", "https://api.lexoffice.io/v1/files", body)
-	if err != nil {
-		return err
+	for _, literal := range msgs[0].BodySection {
+		return literal.Bytes, nil
 	}
 
-	req.Header.Set("Authorization", "Bearer "+config.LexofficeKey)
-	req.Header.Set("Content-Type", writer.FormDataContentType())
-	req.Header.Set("Accept", "application/json")
-
-	client := &http.Client{Timeout: 30 * time.Second}
-	resp, err := client.Do(req)
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
+	return nil, fmt.Errorf("no data for part")
+}
 
-	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		respBody, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("upload failed with status %d: %s", resp.StatusCode, string(respBody))
+func shouldIgnoreFile(filename string) bool {
+	for _, pattern := range IgnorePatterns {
+		if pattern.MatchString(filename) {
+			return true
+		}
 	}
-
-	return nil
+	return false
 }
 
-func moveToFolder(c *imapclient.Client, uid imap.UID, folderName string) error {
-	// Ensure the folder exists
+func moveToFolder(c *imapclient.Client, uid imap.UID, folderName string, config *Config) error {
+	// The whole ensure-folder/copy/flag/expunge sequence is guarded by one
+	// lock: EXPUNGE renumbers every remaining message's sequence number, so it
+	// and the commands around it can't be allowed to interleave with another
+	// goroutine's commands on the same shared connection. See Config.connMu.
+	config.connMu.Lock()
+	defer config.connMu.Unlock()
+
 	if err := ensureFolderExists(c, folderName); err != nil {
 		return err
 	}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Rule describes how to handle messages/attachments matching it. Rules are
+// evaluated in order; the first match wins. An empty matcher field means
+// "don't filter on this".
+type Rule struct {
+	From          string `yaml:"from"`
+	SubjectRegex  string `yaml:"subject_regex"`
+	FilenameRegex string `yaml:"filename_regex"`
+	MimeType      string `yaml:"mime_type"`
+
+	UploadAs  string `yaml:"upload_as"`
+	MoveTo    string `yaml:"move_to"`
+	Skip      bool   `yaml:"skip"`
+	Tag       string `yaml:"tag"` // forwarded as-is by BACKEND=webhook only, see UploadMeta
+	ForwardTo string `yaml:"forward_to"`
+
+	subjectRegex  *regexp.Regexp
+	filenameRegex *regexp.Regexp
+}
+
+// RuleSet is the top-level shape of the RULES_FILE YAML document.
+type RuleSet struct {
+	Rules []*Rule `yaml:"rules"`
+}
+
+// loadRules reads and compiles the rules file at path. A nil, nil return
+// (empty path) means no rules file was configured.
+func loadRules(path string) (*RuleSet, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read rules file: %w", err)
+	}
+
+	var rs RuleSet
+	if err := yaml.Unmarshal(data, &rs); err != nil {
+		return nil, fmt.Errorf("failed to parse rules file: %w", err)
+	}
+
+	for i, r := range rs.Rules {
+		if r.SubjectRegex != "" {
+			re, err := regexp.Compile(r.SubjectRegex)
+			if err != nil {
+				return nil, fmt.Errorf("rule %d: invalid subject_regex: %w", i, err)
+			}
+			r.subjectRegex = re
+		}
+		if r.FilenameRegex != "" {
+			re, err := regexp.Compile(r.FilenameRegex)
+			if err != nil {
+				return nil, fmt.Errorf("rule %d: invalid filename_regex: %w", i, err)
+			}
+			r.filenameRegex = re
+		}
+	}
+
+	return &rs, nil
+}
+
+// match finds the first rule whose matchers all apply to this attachment.
+func (rs *RuleSet) match(meta UploadMeta, filename, mimeType string) *Rule {
+	if rs == nil {
+		return nil
+	}
+
+	for _, r := range rs.Rules {
+		if r.From != "" && !strings.Contains(strings.ToLower(meta.From), strings.ToLower(r.From)) {
+			continue
+		}
+		if r.subjectRegex != nil && !r.subjectRegex.MatchString(meta.Subject) {
+			continue
+		}
+		if r.filenameRegex != nil && !r.filenameRegex.MatchString(filename) {
+			continue
+		}
+		if r.MimeType != "" && !strings.EqualFold(r.MimeType, mimeType) {
+			continue
+		}
+		return r
+	}
+
+	return nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestRuleSetMatch(t *testing.T) {
+	amazonRule := &Rule{From: "amazon.de", UploadAs: "receipt"}
+	agbRule := &Rule{FilenameRegex: "AGB", filenameRegex: regexp.MustCompile("AGB"), Skip: true}
+	invoiceSubjectRule := &Rule{SubjectRegex: "Invoice", subjectRegex: regexp.MustCompile("Invoice"), Tag: "invoice"}
+	pdfRule := &Rule{MimeType: "application/pdf", MoveTo: "pdfs"}
+
+	rs := &RuleSet{Rules: []*Rule{amazonRule, agbRule, invoiceSubjectRule, pdfRule}}
+
+	tests := []struct {
+		name     string
+		meta     UploadMeta
+		filename string
+		mimeType string
+		want     *Rule
+	}{
+		{
+			name:     "matches by sender substring, case-insensitive",
+			meta:     UploadMeta{From: "Billing@AMAZON.de"},
+			filename: "receipt.pdf",
+			mimeType: "application/pdf",
+			want:     amazonRule,
+		},
+		{
+			name:     "matches by filename regex",
+			meta:     UploadMeta{From: "someone@example.com"},
+			filename: "AGB_2026.pdf",
+			mimeType: "application/pdf",
+			want:     agbRule,
+		},
+		{
+			name:     "matches by subject regex",
+			meta:     UploadMeta{From: "someone@example.com", Subject: "Your Invoice #123"},
+			filename: "doc.pdf",
+			mimeType: "application/pdf",
+			want:     invoiceSubjectRule,
+		},
+		{
+			name:     "falls through to mime type match",
+			meta:     UploadMeta{From: "someone@example.com", Subject: "Hello"},
+			filename: "doc.pdf",
+			mimeType: "application/pdf",
+			want:     pdfRule,
+		},
+		{
+			name:     "no rule matches",
+			meta:     UploadMeta{From: "someone@example.com", Subject: "Hello"},
+			filename: "doc.txt",
+			mimeType: "text/plain",
+			want:     nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := rs.match(tt.meta, tt.filename, tt.mimeType)
+			if got != tt.want {
+				t.Errorf("match() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRuleSetMatchNilRuleSet(t *testing.T) {
+	var rs *RuleSet
+	if got := rs.match(UploadMeta{}, "x.pdf", "application/pdf"); got != nil {
+		t.Errorf("match() on nil RuleSet = %v, want nil", got)
+	}
+}
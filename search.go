@@ -0,0 +1,109 @@
+package main
+
+import (
+	"log"
+	"os"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+)
+
+// SearchConfig holds the server-side SEARCH criteria used to select which
+// messages in the mailbox get processed, so large inboxes don't need a full
+// scan on every run.
+type SearchConfig struct {
+	Unseen        bool
+	From          string
+	Subject       string
+	SubjectRegex  string
+	SinceDays     int
+	MinSizeKB     int64
+	MaxSizeKB     int64
+	HasAttachment bool
+
+	subjectRegex *regexp.Regexp
+}
+
+func loadSearchConfig() *SearchConfig {
+	sc := &SearchConfig{
+		Unseen:        os.Getenv("SEARCH_UNSEEN") == "true",
+		From:          os.Getenv("SEARCH_FROM"),
+		Subject:       os.Getenv("SEARCH_SUBJECT"),
+		SubjectRegex:  os.Getenv("SEARCH_SUBJECT_REGEX"),
+		HasAttachment: os.Getenv("SEARCH_HAS_ATTACHMENT") == "true",
+	}
+
+	if sc.SubjectRegex != "" {
+		re, err := regexp.Compile(sc.SubjectRegex)
+		if err != nil {
+			log.Printf("Ignoring invalid SEARCH_SUBJECT_REGEX %q: %v", sc.SubjectRegex, err)
+		} else {
+			sc.subjectRegex = re
+		}
+	}
+
+	if val := os.Getenv("SEARCH_SINCE_DAYS"); val != "" {
+		if days, err := strconv.Atoi(val); err == nil {
+			sc.SinceDays = days
+		}
+	}
+	if val := os.Getenv("SEARCH_MIN_SIZE_KB"); val != "" {
+		if size, err := strconv.ParseInt(val, 10, 64); err == nil {
+			sc.MinSizeKB = size
+		}
+	}
+	if val := os.Getenv("SEARCH_MAX_SIZE_KB"); val != "" {
+		if size, err := strconv.ParseInt(val, 10, 64); err == nil {
+			sc.MaxSizeKB = size
+		}
+	}
+
+	return sc
+}
+
+// buildCriteria turns the configured SEARCH_* env vars into an IMAP SEARCH
+// criteria. A zero-value SearchConfig produces a criteria matching every
+// message, preserving the previous full-mailbox behavior.
+//
+// SEARCH_SUBJECT is a plain IMAP SEARCH SUBJECT match (substring, not
+// regex - that's all the protocol supports server-side); SEARCH_SUBJECT_REGEX
+// and HasAttachment have no server-side equivalent at all, since the former
+// needs real regex semantics and the latter needs BODYSTRUCTURE, so both are
+// applied as a post-filter over the SEARCH results instead. See
+// matchesSubjectRegex and filterSearchResults in main.go.
+func (sc *SearchConfig) buildCriteria() *imap.SearchCriteria {
+	criteria := &imap.SearchCriteria{}
+
+	if sc.Unseen {
+		criteria.NotFlag = append(criteria.NotFlag, imap.FlagSeen)
+	}
+	if sc.From != "" {
+		criteria.Header = append(criteria.Header, imap.SearchCriteriaHeader{Key: "From", Value: sc.From})
+	}
+	if sc.Subject != "" {
+		criteria.Header = append(criteria.Header, imap.SearchCriteriaHeader{Key: "Subject", Value: sc.Subject})
+	}
+	if sc.SinceDays > 0 {
+		criteria.Since = time.Now().AddDate(0, 0, -sc.SinceDays)
+	}
+	if sc.MinSizeKB > 0 {
+		criteria.Larger = sc.MinSizeKB * 1024
+	}
+	if sc.MaxSizeKB > 0 {
+		criteria.Smaller = sc.MaxSizeKB * 1024
+	}
+
+	return criteria
+}
+
+// matchesSubjectRegex reports whether subject satisfies SEARCH_SUBJECT_REGEX.
+// Returns true when no regex is configured (or it failed to compile), so it's
+// safe to call unconditionally as a post-filter predicate.
+func (sc *SearchConfig) matchesSubjectRegex(subject string) bool {
+	if sc.subjectRegex == nil {
+		return true
+	}
+	return sc.subjectRegex.MatchString(subject)
+}
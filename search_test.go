@@ -0,0 +1,86 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSearchConfigBuildCriteria(t *testing.T) {
+	t.Run("zero value matches everything", func(t *testing.T) {
+		sc := &SearchConfig{}
+		criteria := sc.buildCriteria()
+		if len(criteria.NotFlag) != 0 || len(criteria.Header) != 0 || !criteria.Since.IsZero() ||
+			criteria.Larger != 0 || criteria.Smaller != 0 {
+			t.Errorf("buildCriteria() on zero value = %+v, want an empty criteria", criteria)
+		}
+	})
+
+	t.Run("unseen sets NotFlag", func(t *testing.T) {
+		sc := &SearchConfig{Unseen: true}
+		criteria := sc.buildCriteria()
+		if len(criteria.NotFlag) != 1 {
+			t.Fatalf("NotFlag = %v, want one flag", criteria.NotFlag)
+		}
+	})
+
+	t.Run("from and subject become header criteria", func(t *testing.T) {
+		sc := &SearchConfig{From: "invoices@example.com", Subject: "Receipt"}
+		criteria := sc.buildCriteria()
+		if len(criteria.Header) != 2 {
+			t.Fatalf("Header = %v, want 2 entries", criteria.Header)
+		}
+	})
+
+	t.Run("since days is relative to now", func(t *testing.T) {
+		sc := &SearchConfig{SinceDays: 30}
+		criteria := sc.buildCriteria()
+		wantAfter := time.Now().AddDate(0, 0, -31)
+		if criteria.Since.Before(wantAfter) {
+			t.Errorf("Since = %v, want after %v", criteria.Since, wantAfter)
+		}
+	})
+
+	t.Run("size bounds convert KB to bytes", func(t *testing.T) {
+		sc := &SearchConfig{MinSizeKB: 10, MaxSizeKB: 1000}
+		criteria := sc.buildCriteria()
+		if criteria.Larger != 10*1024 || criteria.Smaller != 1000*1024 {
+			t.Errorf("Larger/Smaller = %d/%d, want %d/%d", criteria.Larger, criteria.Smaller, 10*1024, 1000*1024)
+		}
+	})
+}
+
+func TestSearchConfigMatchesSubjectRegex(t *testing.T) {
+	t.Run("no regex configured matches anything", func(t *testing.T) {
+		sc := &SearchConfig{}
+		if !sc.matchesSubjectRegex("anything at all") {
+			t.Error("matchesSubjectRegex() = false, want true when no regex is configured")
+		}
+	})
+
+	t.Run("invalid regex is ignored, falls back to matching everything", func(t *testing.T) {
+		sc := loadSearchConfigForTest(t, map[string]string{"SEARCH_SUBJECT_REGEX": "("})
+		if !sc.matchesSubjectRegex("anything at all") {
+			t.Error("matchesSubjectRegex() = false, want true when the configured regex failed to compile")
+		}
+	})
+
+	t.Run("valid regex filters by subject", func(t *testing.T) {
+		sc := loadSearchConfigForTest(t, map[string]string{"SEARCH_SUBJECT_REGEX": `^Invoice #\d+$`})
+		if !sc.matchesSubjectRegex("Invoice #42") {
+			t.Error("matchesSubjectRegex(\"Invoice #42\") = false, want true")
+		}
+		if sc.matchesSubjectRegex("Re: Invoice #42") {
+			t.Error("matchesSubjectRegex(\"Re: Invoice #42\") = true, want false")
+		}
+	})
+}
+
+// loadSearchConfigForTest sets env and restores it afterwards, since
+// loadSearchConfig reads its config entirely from the environment.
+func loadSearchConfigForTest(t *testing.T, env map[string]string) *SearchConfig {
+	t.Helper()
+	for k, v := range env {
+		t.Setenv(k, v)
+	}
+	return loadSearchConfig()
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+// sha256Hex returns the hex-encoded SHA-256 digest of data, used as the
+// content-addressed key for dedup in the state store.
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+var attachmentsBucket = []byte("attachments")
+
+// AttachmentRecord is stored once per successfully uploaded attachment, keyed
+// by account and the SHA-256 hash of its bytes (see stateKey), so a crash
+// mid-run or a message that
+// reappears in a later SEARCH doesn't cause a duplicate upload.
+type AttachmentRecord struct {
+	MessageID   string    `json:"message_id"`
+	Filename    string    `json:"filename"`
+	UploaderID  string    `json:"uploader_id"`
+	ProcessedAt time.Time `json:"processed_at"`
+}
+
+// StateStore is a BoltDB-backed record of which attachments have already
+// been uploaded.
+type StateStore struct {
+	db *bbolt.DB
+}
+
+// openStateStore opens (creating if necessary) the state database at path
+// and ensures its buckets exist.
+func openStateStore(path string) (*StateStore, error) {
+	db, err := bbolt.Open(path, 0o600, &bbolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open state db: %w", err)
+	}
+
+	err = db.Update(func(tx *bbolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(attachmentsBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to migrate state db: %w", err)
+	}
+
+	return &StateStore{db: db}, nil
+}
+
+func (s *StateStore) Close() error {
+	return s.db.Close()
+}
+
+// stateKey scopes a content hash to the account it was seen on, so the same
+// attachment bytes landing in two different accounts' mailboxes (e.g. two
+// clients of a bookkeeper) are tracked, and uploaded, independently.
+func stateKey(account, hash string) []byte {
+	return []byte(account + ":" + hash)
+}
+
+// IsProcessed reports whether an attachment with this content hash has
+// already been uploaded successfully for the given account.
+func (s *StateStore) IsProcessed(account, hash string) (bool, error) {
+	found := false
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		found = tx.Bucket(attachmentsBucket).Get(stateKey(account, hash)) != nil
+		return nil
+	})
+	return found, err
+}
+
+// MarkProcessed records that the attachment with this content hash was
+// uploaded successfully for the given account.
+func (s *StateStore) MarkProcessed(account, hash string, record AttachmentRecord) error {
+	record.ProcessedAt = time.Now()
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(attachmentsBucket).Put(stateKey(account, hash), data)
+	})
+}
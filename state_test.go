@@ -0,0 +1,44 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestStateKeyScopesByAccount(t *testing.T) {
+	a := stateKey("accountA", "deadbeef")
+	b := stateKey("accountB", "deadbeef")
+	if string(a) == string(b) {
+		t.Errorf("stateKey() produced the same key for different accounts: %q", a)
+	}
+}
+
+func TestStateStoreIsProcessedScopedPerAccount(t *testing.T) {
+	store, err := openStateStore(filepath.Join(t.TempDir(), "state.db"))
+	if err != nil {
+		t.Fatalf("openStateStore() error = %v", err)
+	}
+	defer store.Close()
+
+	const hash = "sameattachmenthash"
+
+	if err := store.MarkProcessed("clientA", hash, AttachmentRecord{Filename: "receipt.pdf"}); err != nil {
+		t.Fatalf("MarkProcessed() error = %v", err)
+	}
+
+	processedA, err := store.IsProcessed("clientA", hash)
+	if err != nil {
+		t.Fatalf("IsProcessed(clientA) error = %v", err)
+	}
+	if !processedA {
+		t.Error("IsProcessed(clientA) = false, want true after MarkProcessed")
+	}
+
+	processedB, err := store.IsProcessed("clientB", hash)
+	if err != nil {
+		t.Fatalf("IsProcessed(clientB) error = %v", err)
+	}
+	if processedB {
+		t.Error("IsProcessed(clientB) = true, want false: a byte-identical attachment in a different account must not be treated as already uploaded")
+	}
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// sharedHTTPClient is reused by the Lexoffice and webhook backends so
+// accounts share one connection pool instead of dialing fresh TLS connections
+// per upload. The S3 backend uses the AWS SDK's own HTTP client.
+var sharedHTTPClient = &http.Client{Timeout: 30 * time.Second}
+
+// UploadMeta carries context about the source message alongside the
+// attachment bytes. Category maps to the Lexoffice voucher "type" and is
+// honored by every backend that has a notion of it; Tag is forwarded as-is
+// by webhookUploader only - the Lexoffice and S3 APIs this client talks to
+// have no tagging concept, so a rule's tag: action is a no-op there.
+type UploadMeta struct {
+	MessageID string
+	From      string
+	Subject   string
+	Category  string
+	Tag       string
+}
+
+// Uploader is implemented by every receipt-store backend. filename and mime
+// describe the attachment being stored; data is its raw bytes. Upload
+// returns the backend's identifier for the stored object, if it has one, so
+// callers can record it alongside the attachment in the state store.
+type Uploader interface {
+	Upload(ctx context.Context, filename, mime string, data []byte, meta UploadMeta) (id string, err error)
+}
+
+// limitedUploader wraps an Uploader with a shared semaphore, so multiple
+// accounts running concurrently still bound the total number of in-flight
+// uploads against the backend API.
+type limitedUploader struct {
+	inner Uploader
+	sem   chan struct{}
+}
+
+// newLimitedUploader returns inner unchanged if sem is nil (unbounded).
+func newLimitedUploader(inner Uploader, sem chan struct{}) Uploader {
+	if sem == nil {
+		return inner
+	}
+	return &limitedUploader{inner: inner, sem: sem}
+}
+
+func (u *limitedUploader) Upload(ctx context.Context, filename, mime string, data []byte, meta UploadMeta) (string, error) {
+	select {
+	case u.sem <- struct{}{}:
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+	defer func() { <-u.sem }()
+
+	return u.inner.Upload(ctx, filename, mime, data, meta)
+}
+
+// newUploader selects and configures the Uploader backend named by
+// config.Backend (default "lexoffice").
+func newUploader(config *Config) (Uploader, error) {
+	switch config.Backend {
+	case "", "lexoffice":
+		return &lexofficeUploader{apiKey: config.LexofficeKey}, nil
+	case "fs":
+		return &fsUploader{dir: getEnvOrDefault("FS_OUTPUT_PATH", "./output")}, nil
+	case "s3":
+		return newS3Uploader()
+	case "webhook":
+		url := os.Getenv("WEBHOOK_URL")
+		if url == "" {
+			return nil, fmt.Errorf("WEBHOOK_URL is required when BACKEND=webhook")
+		}
+		return &webhookUploader{url: url, client: sharedHTTPClient}, nil
+	default:
+		return nil, fmt.Errorf("unknown BACKEND %q", config.Backend)
+	}
+}
+
+// lexofficeUploader uploads attachments as vouchers via the Lexoffice API.
+// This is the original, and still default, upload path.
+type lexofficeUploader struct {
+	apiKey string
+}
+
+func (u *lexofficeUploader) Upload(ctx context.Context, filename, mime string, data []byte, meta UploadMeta) (string, error) {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+
+	part, err := writer.CreateFormFile("file", filename)
+	if err != nil {
+		return "", err
+	}
+	if _, err := part.Write(data); err != nil {
+		return "", err
+	}
+	category := meta.Category
+	if category == "" {
+		category = "voucher"
+	}
+	if err := writer.WriteField("type", category); err != nil {
+		return "", err
+	}
+	if err := writer.Close(); err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", "https://api.lexoffice.io/v1/files", body)
+	if err != nil {
+		return "", err
+	}
+
+	req.Header.Set("Authorization", "Bearer "+u.apiKey)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := sharedHTTPClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return "", fmt.Errorf("upload failed with status %d: %s", resp.StatusCode, string(respBody))
+	}
+
+	var result struct {
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal(respBody, &result); err != nil {
+		return "", fmt.Errorf("failed to parse lexoffice response: %w", err)
+	}
+
+	return result.ID, nil
+}
+
+// fsUploader writes attachments to a local directory, mirroring getimap's
+// output.path behavior.
+type fsUploader struct {
+	dir string
+}
+
+func (u *fsUploader) Upload(ctx context.Context, filename, mime string, data []byte, meta UploadMeta) (string, error) {
+	base := filepath.Base(filename)
+	if base == "" || base == "." || base == ".." || base == string(filepath.Separator) {
+		return "", fmt.Errorf("invalid attachment filename %q", filename)
+	}
+
+	if err := os.MkdirAll(u.dir, 0o755); err != nil {
+		return "", fmt.Errorf("failed to create output directory: %w", err)
+	}
+
+	path := filepath.Join(u.dir, base)
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		return "", fmt.Errorf("failed to write %s: %w", path, err)
+	}
+
+	return path, nil
+}
+
+// s3Uploader uploads attachments as objects to an S3-compatible bucket.
+type s3Uploader struct {
+	client *s3.Client
+	bucket string
+	prefix string
+}
+
+func newS3Uploader() (*s3Uploader, error) {
+	bucket := os.Getenv("S3_BUCKET")
+	if bucket == "" {
+		return nil, fmt.Errorf("S3_BUCKET is required when BACKEND=s3")
+	}
+
+	cfg, err := config.LoadDefaultConfig(context.Background(),
+		config.WithRegion(getEnvOrDefault("S3_REGION", "us-east-1")),
+		config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(
+			os.Getenv("S3_ACCESS_KEY_ID"), os.Getenv("S3_SECRET_ACCESS_KEY"), "")),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load S3 config: %w", err)
+	}
+
+	client := s3.NewFromConfig(cfg, func(o *s3.Options) {
+		if endpoint := os.Getenv("S3_ENDPOINT"); endpoint != "" {
+			o.BaseEndpoint = aws.String(endpoint)
+			o.UsePathStyle = true
+		}
+	})
+
+	return &s3Uploader{client: client, bucket: bucket, prefix: os.Getenv("S3_PREFIX")}, nil
+}
+
+func (u *s3Uploader) Upload(ctx context.Context, filename, mime string, data []byte, meta UploadMeta) (string, error) {
+	key := filename
+	if u.prefix != "" {
+		key = filepath.Join(u.prefix, filename)
+	}
+
+	_, err := u.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(u.bucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(data),
+		ContentType: aws.String(mime),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to upload %s to s3: %w", key, err)
+	}
+
+	return key, nil
+}
+
+// webhookUploader POSTs attachments as multipart/form-data to an arbitrary
+// HTTP endpoint, alongside the message metadata.
+type webhookUploader struct {
+	url    string
+	client *http.Client
+}
+
+func (u *webhookUploader) Upload(ctx context.Context, filename, mime string, data []byte, meta UploadMeta) (string, error) {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+
+	part, err := writer.CreateFormFile("file", filename)
+	if err != nil {
+		return "", err
+	}
+	if _, err := part.Write(data); err != nil {
+		return "", err
+	}
+	if err := writer.WriteField("message_id", meta.MessageID); err != nil {
+		return "", err
+	}
+	if err := writer.WriteField("from", meta.From); err != nil {
+		return "", err
+	}
+	if err := writer.WriteField("subject", meta.Subject); err != nil {
+		return "", err
+	}
+	if err := writer.WriteField("category", meta.Category); err != nil {
+		return "", err
+	}
+	if err := writer.WriteField("tag", meta.Tag); err != nil {
+		return "", err
+	}
+	if err := writer.Close(); err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", u.url, body)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return "", fmt.Errorf("webhook upload failed with status %d: %s", resp.StatusCode, string(respBody))
+	}
+
+	return "", nil
+}